@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// iceServer mirrors the JSON shape of a single STUN/TURN entry, matching
+// what a browser's RTCConfiguration expects.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// iceConfiguration loads the ICE server list from the JSON file at path and
+// turns it into a webrtc.Configuration. A missing file is not an error; it
+// just means peer connections are created with no STUN/TURN servers and
+// only host candidates are gathered.
+func iceConfiguration(path string) (webrtc.Configuration, error) {
+	var config webrtc.Configuration
+	if path == "" {
+		return config, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return config, fmt.Errorf("ice configuration: %w", err)
+	}
+	defer f.Close()
+
+	var servers []iceServer
+	if err := json.NewDecoder(f).Decode(&servers); err != nil {
+		return config, fmt.Errorf("ice configuration: %w", err)
+	}
+
+	for _, s := range servers {
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: s.Credential,
+		})
+	}
+
+	return config, nil
+}
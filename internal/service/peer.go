@@ -0,0 +1,79 @@
+package service
+
+import "errors"
+
+// errClosed is returned by Enqueue once a Peer's event loop has stopped.
+var errClosed = errors.New("service: peer closed")
+
+// event is one unit of work queued on a Peer's event loop.
+type event struct {
+	fn   func() error
+	done chan error
+}
+
+// Peer represents one connected client and the uData associated with it.
+// Every PacketHandler dispatched for this Peer, and every other caller that
+// needs to touch uData, runs its work through Enqueue, which serializes it
+// onto the Peer's own goroutine — so uData never needs its own lock.
+type Peer struct {
+	uData  interface{}
+	events chan event
+	closed chan struct{}
+}
+
+// NewPeer starts a Peer's event loop around uData and returns it. Callers
+// are responsible for eventually calling Close.
+func NewPeer(uData interface{}) *Peer {
+	p := &Peer{
+		uData:  uData,
+		events: make(chan event, 16),
+		closed: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *Peer) run() {
+	for {
+		select {
+		case ev := <-p.events:
+			ev.done <- ev.fn()
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// UserData returns the value the Peer was created with.
+func (p *Peer) UserData() interface{} {
+	return p.uData
+}
+
+// Enqueue runs fn on the Peer's event loop and blocks until it finishes,
+// returning its error. It is safe to call from any goroutine. A Peer whose
+// loop has already stopped returns errClosed instead of blocking forever.
+func (p *Peer) Enqueue(fn func() error) error {
+	ev := event{fn: fn, done: make(chan error, 1)}
+
+	select {
+	case p.events <- ev:
+	case <-p.closed:
+		return errClosed
+	}
+
+	select {
+	case err := <-ev.done:
+		return err
+	case <-p.closed:
+		return errClosed
+	}
+}
+
+// Close stops the Peer's event loop. A function already running on the loop
+// runs to the end, but functions still queued may be dropped without
+// running. Once the loop has stopped, Enqueue returns errClosed instead of
+// waiting; a call in flight at the moment of Close may return either
+// errClosed or its function's result.
+func (p *Peer) Close() {
+	close(p.closed)
+}
@@ -0,0 +1,49 @@
+// Package service provides a small connection-lifecycle abstraction: a
+// Service owns a set of Peers and dispatches inbound messages to
+// PacketHandlers registered by message type, each running on its Peer's own
+// serialized event loop.
+package service
+
+import "fmt"
+
+// Message is a single inbound packet, tagged with the name its handler was
+// registered under.
+type Message struct {
+	Type string
+	Body interface{}
+}
+
+// PacketHandler processes one Message for a Peer. uData is the value the
+// Peer was created with — the caller's own per-connection state.
+type PacketHandler func(peer *Peer, uData interface{}, msg Message) error
+
+// Service dispatches inbound Messages to the PacketHandler registered for
+// their Type.
+type Service struct {
+	handlers map[string]PacketHandler
+}
+
+// New returns an empty Service.
+func New() *Service {
+	return &Service{handlers: make(map[string]PacketHandler)}
+}
+
+// Handle registers h to process every Message of the given type, replacing
+// any handler previously registered for it.
+func (s *Service) Handle(msgType string, h PacketHandler) {
+	s.handlers[msgType] = h
+}
+
+// Dispatch runs the handler registered for msg.Type on peer's event loop and
+// waits for it to finish, returning its error. It returns an error itself,
+// without touching peer, if no handler is registered for msg.Type.
+func (s *Service) Dispatch(peer *Peer, msg Message) error {
+	h, ok := s.handlers[msg.Type]
+	if !ok {
+		return fmt.Errorf("service: no handler registered for message type %q", msg.Type)
+	}
+
+	return peer.Enqueue(func() error {
+		return h(peer, peer.UserData(), msg)
+	})
+}
@@ -1,264 +1,286 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"net"
 	"net/http"
-	"sync"
-	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+
+	"github.com/cardboardcrusaders/cardboard-calamity-server/internal/service"
 )
 
-// player is a single player, including its connection for the video stream.
+// player is a single connected participant: either an active player
+// publishing video, or an observer only receiving it. It is the uData
+// associated with the player's service.Peer. id, sid and up are set by
+// joinPlayer before the player is shared and are only read afterwards; from
+// then on every other field is written only from that peer's own event loop
+// — room and role by a room's actor via p.peer.Enqueue (see Room.handleJoin)
+// rather than directly. Other goroutines read room the same way (see
+// (*player).currentRoom); the room's actor reads role directly, after the
+// Enqueue call of its own that wrote it.
 type player struct {
-	*sync.Mutex
-	id     int          // Unique identifier
-	active bool         // If the player is playing or not
-	conn   *net.TCPConn // Socket connection for video streaming
+	id      int                            // Unique identifier, assigned by the Matchmaker
+	sid     string                         // Session id; resumes reattach by this, not id
+	active  bool                           // If the connection is currently live
+	role    role                           // "player" or "observer"
+	room    *Room                          // Room this player currently belongs to
+	up      *rtpUpConnection               // This player's published camera track; nil for observers
+	downs   map[*player]*rtpDownConnection // One per publisher this player subscribes to
+	writeCh chan interface{}               // Outbound envelopes for this player's writePump
+	conn    *websocket.Conn                // Underlying socket, so a wedged writeCh can be dropped
+	peer    *service.Peer                  // Owns this player's serialized event loop
 }
 
-// playerPair are two players that are set to work together. They will stream
-// camera input to each other.
-type playerPair struct {
-	p1 *player
-	p2 *player
+// currentRoom returns p's current room, read through p's own event loop
+// since it is only ever written there. finalizePlayer and resumePlayer
+// don't call this directly: they need room alongside other fields they're
+// mutating in the same instant, so they run their own equivalent Enqueue
+// call rather than pay for two round trips.
+func (p *player) currentRoom() *Room {
+	var room *Room
+	p.peer.Enqueue(func() error {
+		room = p.room
+		return nil
+	})
+	return room
 }
 
-// getParter returns the partner of the given player, or null if none exist.
-func getPartner(pp *[]playerPair, index *player) *player {
-	for _, val := range *pp {
-		if val.p1 == index {
-			return val.p2
-		} else if val.p2 == index {
-			return val.p1
-		}
+// handleOffer accepts an SDP offer for the given player's up-connection and
+// returns the corresponding answer.
+func handleOffer(p *player, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if p.up == nil {
+		return nil, fmt.Errorf("%w: player has not published", errProtocolViolation)
 	}
 
-	return nil
-}
+	if err := p.up.pc.SetRemoteDescription(offer); err != nil {
+		return nil, fmt.Errorf("handle offer: %w", err)
+	}
 
-// assignPartner tries to find an unpaired player to pair the given player to.
-// If none exist, the player will be put into a group on its own.
-func assignPartner(pp *[]playerPair, p *player) bool {
-	// Search for players without a partner
-	for _, val := range *pp {
-		val.p1.Lock()
-		val.p2.Lock()
-		defer val.p1.Unlock()
-		defer val.p2.Unlock()
-		if (val.p1 != nil && val.p1.active) && (val.p1 == nil || !val.p2.active) {
-			val.p2 = p
-			return true
-		} else if (val.p1 == nil || !val.p1.active) && (val.p2 != nil && val.p2.active) {
-			val.p1 = p
-			return true
-		}
+	answer, err := p.up.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("handle offer: %w", err)
+	}
+	if err := p.up.pc.SetLocalDescription(answer); err != nil {
+		return nil, fmt.Errorf("handle offer: %w", err)
 	}
 
-	// Put the player on their own
-	*pp = append(*pp, playerPair{p, nil})
-	return false
+	return &answer, nil
 }
 
-// listen starts listening for a video connection on a socket for the given
-// player. This video will be streamed to the partner.
-func listen(p *player, partner *player) {
-	addr, err := net.ResolveTCPAddr("tcp", ":8000")
-	if err != nil {
-		panic(err)
+// handleDownAnswer applies an SDP answer to p's down-connection subscribed
+// to the publisher identified by pubID, completing negotiation for the
+// track it is forwarding.
+func handleDownAnswer(p *player, pubID int, answer webrtc.SessionDescription) error {
+	if p.room == nil {
+		return fmt.Errorf("%w: not yet assigned to a room", errUnknownPlayer)
 	}
-	log.Println("started listening for a connection")
-	ln, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		panic(err)
+	pub, ok := p.room.resolveMember(pubID)
+	if !ok || pub == nil {
+		return fmt.Errorf("%w: unknown publisher %d", errUnknownPlayer, pubID)
+	}
+	down, ok := p.downs[pub]
+	if !ok {
+		return fmt.Errorf("%w: not subscribed to publisher %d", errUnknownPlayer, pubID)
+	}
+
+	if err := down.pc.SetRemoteDescription(answer); err != nil {
+		return fmt.Errorf("handle answer: %w", err)
 	}
-	ln.SetDeadline(time.Now().Add(time.Second * 5))
+	return nil
+}
 
-	for {
-		p.Lock()
-		p.conn, err = ln.AcceptTCP()
+// registerHandlers wires up the PacketHandlers for every envelope type a
+// player can send after joining. Each runs on the sending player's own
+// service.Peer event loop, so they can read and write p's fields directly.
+func registerHandlers(svc *service.Service) {
+	svc.Handle(string(envOffer), func(peer *service.Peer, uData interface{}, msg service.Message) error {
+		p := uData.(*player)
+		env := msg.Body.(envelope)
+		if env.Conn != "up" || env.SDP == nil {
+			return fmt.Errorf("%w: malformed offer", errProtocolViolation)
+		}
+
+		answer, err := handleOffer(p, *env.SDP)
 		if err != nil {
-			log.Println("Socket err:", err)
-			p.Unlock()
-			continue
+			return err
+		}
+		p.writeCh <- envelope{Type: envAnswer, Conn: "up", SDP: answer}
+		return nil
+	})
+
+	svc.Handle(string(envAnswer), func(peer *service.Peer, uData interface{}, msg service.Message) error {
+		p := uData.(*player)
+		env := msg.Body.(envelope)
+		pubID, ok := parseDownConnID(env.Conn)
+		if !ok || env.SDP == nil {
+			return fmt.Errorf("%w: malformed answer", errProtocolViolation)
 		}
+		return handleDownAnswer(p, pubID, *env.SDP)
+	})
 
-		log.Println("connected to player", p.id)
-		p.conn.SetKeepAlive(true)
-		p.conn.SetKeepAlivePeriod(time.Second / 2)
-		p.Unlock()
-		streamVideo(p, partner)
-		p.Lock()
-		log.Println("lost connection to player", p.id)
-		p.Unlock()
-	}
-}
+	svc.Handle(string(envICE), func(peer *service.Peer, uData interface{}, msg service.Message) error {
+		p := uData.(*player)
+		env := msg.Body.(envelope)
+		if env.Candidate == nil {
+			return fmt.Errorf("%w: missing candidate", errProtocolViolation)
+		}
+		return addICECandidate(p, env.Conn, *env.Candidate)
+	})
 
-// streamVideo starts streaming video data between players.
-func streamVideo(src *player, dest *player) {
+	svc.Handle(string(envLeave), func(peer *service.Peer, uData interface{}, msg service.Message) error {
+		// Nothing to do here; the caller tears the connection down once
+		// Dispatch returns.
+		return nil
+	})
+
+	svc.Handle(string(envJoin), func(peer *service.Peer, uData interface{}, msg service.Message) error {
+		return fmt.Errorf("%w: unexpected join on an established session", errProtocolViolation)
+	})
 }
 
-// jsonError creates a JSON structure with the given error message.
-func jsonError(err error) []byte {
-	resp := struct {
-		Error string `json: "error"`
-	}{
-		Error: err.Error(),
+// joinPlayer waits for the initial join envelope on conn, assigns the
+// joiner a fresh id and session id, sets up its peer connections if it's
+// publishing, and hands it to the matchmaker. Join precedes the existence of
+// a player, so it is handled directly here rather than as a registered
+// PacketHandler.
+func joinPlayer(mm *Matchmaker, sessions *sessionRegistry, conn *websocket.Conn) (*player, error) {
+	var env envelope
+	if err := conn.ReadJSON(&env); err != nil {
+		return nil, fmt.Errorf("%w: %v", errProtocolViolation, err)
+	}
+	if env.Type != envJoin {
+		return nil, fmt.Errorf("%w: expected join, got %q", errProtocolViolation, env.Type)
+	}
+
+	size := env.Size
+	if env.Mode != "group" || size == 0 {
+		size = 2
+	}
+
+	rl := rolePlayer
+	if env.Role == string(roleObserver) {
+		rl = roleObserver
 	}
 
-	data, err := json.Marshal(resp)
+	p := &player{id: mm.newPlayerID(), active: true, conn: conn}
+	p.peer = service.NewPeer(p)
+
+	sid, err := generateSID()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	p.sid = sid
+	sessions.register(sid, p)
+
+	if rl == rolePlayer {
+		p.up, err = newUpConnection(mm.iceConfig, p)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return data
+	p.writeCh = make(chan interface{}, 16)
+	go writePump(conn, p.writeCh)
+
+	room := mm.join(p, size, rl)
+	log.Println("player", p.id, "joined", room.id, "as", rl)
+
+	p.writeCh <- envelope{Type: envJoin, ID: p.id, SID: sid, RoomID: room.id}
+
+	return p, nil
 }
 
-func main() {
-	players := [2]*player{
-		{id: 1, active: false},
-		{id: 2, active: false},
+// finalizePlayer permanently deactivates p and tells its room it left. Used
+// both for a voluntary leave and for a session whose grace period expired
+// without resuming.
+func finalizePlayer(p *player) {
+	var room *Room
+	p.peer.Enqueue(func() error {
+		p.active = false
+		room = p.room
+		teardownPlayerConnections(p)
+		return nil
+	})
+
+	if room != nil {
+		room.inbox <- roomEvent{kind: roomLeave, player: p}
 	}
 
-	pairs := make([]playerPair, 0, 1)
-
-	http.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
-		post := func(w http.ResponseWriter, r *http.Request) {
-			log.Println("recieved a player join request")
-
-			// Find a non-existant player to assign the joiner to
-			var p *player
-			var id int
-			for _, val := range players {
-				val.Lock()
-				if !val.active {
-					p = val
-					id = p.id
-					val.Unlock()
-					break
-				}
-				val.Unlock()
-			}
-			// If there are no available player slots, send an error
-			if id == 0 {
-				w.Write(jsonError(errors.New("maximum amount of players reached")))
-				return
-			}
+	p.peer.Close()
+}
 
-			// Read the request body
-			body, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				w.Write(jsonError(err))
-				return
-			}
-			defer r.Body.Close()
-			// Decode the request body JSON
-			var data map[string]interface{}
-			err = json.Unmarshal(body, &data)
-			if err != nil {
-				w.Write(jsonError(err))
-				return
-			}
+func main() {
+	iceConfig, err := iceConfiguration("ice.json")
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-			log.Println("accepted join request for player", id)
+	mm := newMatchmaker(iceConfig)
+	sessions := newSessionRegistry()
+	go sessions.reap()
 
-			// Give the player a partner if possible
-			assigned := assignPartner(&pairs, p)
-			if assigned {
-				log.Println("player", id, "was assigned with player", getPartner(&pairs, p))
-			} else {
-				log.Println("player", id, "was assigned to their own group")
-			}
+	svc := service.New()
+	registerHandlers(svc)
 
-			// Wait for a video stream
-			go listen(p, getPartner(&pairs, p))
+	http.HandleFunc("/stats", statsHandler(mm))
+	http.HandleFunc("/stats/", statsHandler(mm))
 
-			// Construct the response
-			resp := struct {
-				ID int `json: "id"`
-			}{
-				ID: id,
-			}
+	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		sid := r.URL.Query().Get("sid")
 
-			// Convert the response to JSON and send
-			out, err := json.Marshal(resp)
-			if err != nil {
-				w.Write(jsonError(err))
-				return
-			}
-			w.Write(out)
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("ws upgrade:", err)
+			return
 		}
 
-		del := func(w http.ResponseWriter, r *http.Request) {
-			// Get the request body
-			body, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				w.Write(jsonError(err))
-				return
-			}
-			defer r.Body.Close()
-
-			// Unmarshal the response
-			var info map[string]interface{}
-			err = json.Unmarshal(body, &info)
+		var p *player
+		if sid != "" {
+			p = resumePlayer(sessions, sid, conn)
+		}
+		if p == nil {
+			p, err = joinPlayer(mm, sessions, conn)
 			if err != nil {
-				w.Write(jsonError(err))
+				conn.WriteMessage(websocket.CloseMessage, errorToWSCloseMessage(err))
+				conn.Close()
 				return
 			}
+		}
 
-			// Get the ID field
-			var ok bool
-			var id int
-			if id, ok = info["id"].(int); !ok {
-				w.Write(jsonError(errors.New("id expected in request body")))
-				return
-			}
-
-			// Find the player with the ID and deregister them
-			deleted := false
-			for _, val := range players {
-				val.Lock()
-				if val.id == id && val.active {
-					val.active = false
-					deleted = true
-					val.Unlock()
-					break
-				}
-				val.Unlock()
-			}
-
-			// If the user was not found, complain
-			if !deleted {
-				w.Write(jsonError(errors.New("no active player with that id")))
-				return
+		voluntary := false
+		for {
+			var env envelope
+			if err := conn.ReadJSON(&env); err != nil {
+				log.Println("ws read:", err)
+				break
 			}
 
-			// Construct the response
-			resp := struct {
-				ID int `json: "id"`
-			}{
-				ID: id,
+			if err := svc.Dispatch(p.peer, service.Message{Type: string(env.Type), Body: env}); err != nil {
+				conn.WriteMessage(websocket.CloseMessage, errorToWSCloseMessage(err))
+				break
 			}
 
-			// Marshal the response and send it
-			data, err := json.Marshal(resp)
-			if err != nil {
-				w.Write(jsonError(err))
-				return
+			if env.Type == envLeave {
+				voluntary = true
+				break
 			}
-			w.Write(data)
 		}
 
-		// Take different actions based on the request type
-		switch r.Method {
-		case "POST":
-			post(w, r)
-		case "DELETE":
-			del(w, r)
-		default:
-			w.Write(jsonError(errors.New("requests must either be POSTs or DELETEs")))
+		p.peer.Enqueue(func() error {
+			close(p.writeCh)
+			p.writeCh = nil
+			return nil
+		})
+		conn.Close()
+
+		if voluntary {
+			sessions.forget(p.sid)
+			finalizePlayer(p)
+		} else {
+			sessions.markDisconnected(p.sid)
+			suspendPlayer(p)
 		}
 	})
 
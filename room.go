@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// role identifies how a member participates in a room: players publish and
+// subscribe, observers only subscribe.
+type role string
+
+const (
+	rolePlayer   role = "player"
+	roleObserver role = "observer"
+)
+
+// roomEventKind tags a message sent to a room's actor goroutine.
+type roomEventKind string
+
+const (
+	roomJoin       roomEventKind = "join"
+	roomLeave      roomEventKind = "leave"
+	roomResumed    roomEventKind = "resumed"
+	roomStats      roomEventKind = "stats"
+	roomTrackReady roomEventKind = "track_ready"
+	roomResolve    roomEventKind = "resolve"
+)
+
+// roomEvent is how player goroutines talk to a room's actor: membership
+// changes are requests on this channel, never direct field writes, so
+// room.members is only ever touched from the actor goroutine itself.
+type roomEvent struct {
+	kind        roomEventKind
+	player      *player
+	role        role
+	lookupID    int               // set for kind roomResolve
+	reply       chan roomSnapshot // set for kind roomStats
+	playerReply chan *player      // set for kind roomResolve
+}
+
+// Room is a group of players and observers who share video with each other,
+// owned entirely by its own actor goroutine.
+type Room struct {
+	id        string
+	capacity  int
+	iceConfig webrtc.Configuration
+	createdAt time.Time
+	members   []*player
+	inbox     chan roomEvent
+	onEmpty   func(id string)
+}
+
+// newRoom creates a room with the given capacity and starts its actor.
+// onEmpty, if non-nil, is called from the actor goroutine once the room's
+// last member leaves, just before its inbox is closed.
+func newRoom(id string, capacity int, iceConfig webrtc.Configuration, onEmpty func(id string)) *Room {
+	r := &Room{
+		id:        id,
+		capacity:  capacity,
+		iceConfig: iceConfig,
+		createdAt: time.Now(),
+		inbox:     make(chan roomEvent, 32),
+		onEmpty:   onEmpty,
+	}
+	go r.actor()
+	return r
+}
+
+// actor processes room events one at a time until the room empties out.
+func (r *Room) actor() {
+	for ev := range r.inbox {
+		switch ev.kind {
+		case roomJoin:
+			r.handleJoin(ev.player, ev.role)
+		case roomLeave:
+			r.handleLeave(ev.player)
+		case roomResumed:
+			r.broadcastExcept(ev.player, envelope{Type: envResumed, ID: ev.player.id})
+		case roomStats:
+			ev.reply <- r.buildSnapshot()
+		case roomTrackReady:
+			r.handleTrackReady(ev.player)
+		case roomResolve:
+			ev.playerReply <- r.byID(ev.lookupID)
+		}
+	}
+}
+
+// handleJoin adds p to the room, subscribes it to every existing
+// publisher's track, subscribes every existing member to p's track if p is
+// itself a publisher, and broadcasts the new roster.
+func (r *Room) handleJoin(p *player, rl role) {
+	p.peer.Enqueue(func() error {
+		p.room = r
+		p.role = rl
+		return nil
+	})
+
+	for _, other := range r.members {
+		if other.role == rolePlayer {
+			subscribeTrack(p, other, r.iceConfig)
+		}
+		if rl == rolePlayer {
+			subscribeTrack(other, p, r.iceConfig)
+		}
+	}
+
+	r.members = append(r.members, p)
+	log.Println("room", r.id, "player", p.id, "joined as", rl)
+	r.broadcastRoster()
+}
+
+// handleTrackReady subscribes every other member of the room to p's
+// just-negotiated published track. It's the (re)subscription handleJoin
+// can't do itself: at join time a player's up-connection exists but hasn't
+// negotiated a track yet, so subscribeTrack there is a no-op; this runs once
+// that track actually arrives, via newUpConnection's OnTrack callback.
+func (r *Room) handleTrackReady(p *player) {
+	for _, other := range r.members {
+		if other != p {
+			subscribeTrack(other, p, r.iceConfig)
+		}
+	}
+}
+
+// notifyTrackReady tells p's room (if it has joined one yet) that p's
+// published track is now available, so existing members can subscribe to
+// it. Called from newUpConnection's OnTrack callback, which runs on pion's
+// own goroutine. trySendRoomEvent guards against the room having already
+// retired (and closed its inbox) by the time this reaches it, the same race
+// Matchmaker.join and Room.snapshot already guard against.
+func notifyTrackReady(p *player) {
+	room := p.currentRoom()
+	if room != nil {
+		trySendRoomEvent(room, roomEvent{kind: roomTrackReady, player: p})
+	}
+}
+
+// handleLeave removes p from the room and broadcasts the new roster. An
+// empty room retires by closing its own inbox, ending the actor.
+func (r *Room) handleLeave(p *player) {
+	members := r.members[:0]
+	for _, m := range r.members {
+		if m != p {
+			members = append(members, m)
+		}
+	}
+	r.members = members
+
+	r.broadcastRoster()
+
+	if len(r.members) == 0 {
+		if r.onEmpty != nil {
+			r.onEmpty(r.id)
+		}
+		close(r.inbox)
+	}
+}
+
+// broadcastRoster pushes the current member id list to every member.
+func (r *Room) broadcastRoster() {
+	ids := make([]int, len(r.members))
+	for i, m := range r.members {
+		ids[i] = m.id
+	}
+
+	env := envelope{Type: envRoster, RoomID: r.id, Members: ids}
+	for _, m := range r.members {
+		sendToMember(m, env)
+	}
+}
+
+// broadcastExcept pushes env to every member other than except.
+func (r *Room) broadcastExcept(except *player, env envelope) {
+	for _, m := range r.members {
+		if m == except {
+			continue
+		}
+		sendToMember(m, env)
+	}
+}
+
+// sendToMember delivers env to m's writeCh without blocking on it when it is
+// full; it does wait for m's event loop to run the send. A full writeCh means m's writePump can't keep up or the connection is
+// already wedged; since the actor processes r.inbox strictly serially, an
+// unconditional send here would let one stuck member stall every other
+// member's roster/resume/stats traffic. Drop the message and close m's
+// socket instead, which unblocks its read loop and lets the existing
+// disconnect/grace-period path finalize it.
+//
+// m.writeCh is replaced by resumePlayer after a reconnect and set to nil
+// once the connection's own goroutine closes it on disconnect, so the read
+// and the send both run inside the same Enqueue call on m's own event loop
+// rather than off the room actor's goroutine — otherwise a send could race
+// a concurrent close of the same channel and panic.
+func sendToMember(m *player, env envelope) {
+	m.peer.Enqueue(func() error {
+		if m.writeCh == nil {
+			return nil
+		}
+		select {
+		case m.writeCh <- env:
+		default:
+			log.Println("room: member", m.id, "write channel full, dropping connection")
+			if m.conn != nil {
+				m.conn.Close()
+			}
+		}
+		return nil
+	})
+}
+
+// byID returns the member with the given player id, or nil if none match.
+// Only ever called from the actor goroutine itself — byID ranges r.members
+// with no synchronization, which handleJoin/handleLeave mutate concurrently
+// from that same goroutine. Call resolveMember instead from anywhere else.
+func (r *Room) byID(id int) *player {
+	for _, m := range r.members {
+		if m.id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// resolveMember asks the room's actor for the member with the given id and
+// waits for the reply, the safe way to do the equivalent of byID from a
+// player's own service.Peer event loop (handleDownAnswer, addICECandidate)
+// rather than racing the actor's membership mutations directly. It returns
+// ok=false if the room has already retired, the same race Room.snapshot
+// already guards against on the stats path.
+func (r *Room) resolveMember(id int) (p *player, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	reply := make(chan *player, 1)
+	r.inbox <- roomEvent{kind: roomResolve, lookupID: id, playerReply: reply}
+	return <-reply, true
+}
+
+// trackSnapshot is the reported stats for one publisher/subscriber leg of a
+// room's SFU forwarding path.
+type trackSnapshot struct {
+	PublisherID  int    `json:"publisherId"`
+	SubscriberID int    `json:"subscriberId"`
+	TxBytes      uint64 `json:"txBytes"`
+	TxPackets    uint64 `json:"txPackets"`
+	RxBytes      uint64 `json:"rxBytes"`
+	RxPackets    uint64 `json:"rxPackets"`
+	Nulled       uint64 `json:"nulled"`
+	Deficit      uint64 `json:"deficit"`
+}
+
+// roomSnapshot is a point-in-time report of a room's membership and
+// per-track bandwidth counters, returned to the /stats handler.
+type roomSnapshot struct {
+	ID        string          `json:"id"`
+	Capacity  int             `json:"capacity"`
+	Players   int             `json:"players"`
+	Observers int             `json:"observers"`
+	Uptime    time.Duration   `json:"uptimeNanos"`
+	Tracks    []trackSnapshot `json:"tracks"`
+}
+
+// buildSnapshot gathers roomSnapshot from current member state. Only ever
+// called from the actor goroutine, in response to a roomStats event.
+func (r *Room) buildSnapshot() roomSnapshot {
+	snap := roomSnapshot{
+		ID:       r.id,
+		Capacity: r.capacity,
+		Uptime:   time.Since(r.createdAt),
+	}
+
+	for _, m := range r.members {
+		if m.role == rolePlayer {
+			snap.Players++
+		} else {
+			snap.Observers++
+		}
+
+		if m.up != nil {
+			for _, down := range m.up.snapshotSubs() {
+				s := down.stats.snapshot()
+				snap.Tracks = append(snap.Tracks, trackSnapshot{
+					PublisherID:  m.id,
+					SubscriberID: down.subscriberID,
+					TxBytes:      s.txBytes,
+					TxPackets:    s.txPackets,
+					Nulled:       s.nulled,
+					Deficit:      s.deficit,
+				})
+			}
+			rx := m.up.stats.snapshot()
+			snap.Tracks = append(snap.Tracks, trackSnapshot{
+				PublisherID: m.id,
+				RxBytes:     rx.rxBytes,
+				RxPackets:   rx.rxPackets,
+			})
+		}
+	}
+
+	return snap
+}
+
+// snapshot asks the room's actor for a roomSnapshot and waits for the reply.
+// It returns ok=false if the room has already retired, which can race
+// harmlessly with a concurrent stats request since an empty room closes its
+// own inbox right after its last member leaves.
+func (r *Room) snapshot() (snap roomSnapshot, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	reply := make(chan roomSnapshot, 1)
+	r.inbox <- roomEvent{kind: roomStats, reply: reply}
+	return <-reply, true
+}
+
+// Matchmaker assigns joiners to rooms by requested room size. The first
+// joiner for a size spawns a room at once and later joiners are added to it
+// until `size` players (not counting observers) have been assigned; joiners
+// are not held in a waiting queue until a room can be filled.
+type Matchmaker struct {
+	mu           sync.Mutex
+	iceConfig    webrtc.Configuration
+	nextRoomID   int
+	nextPlayerID int
+	pending      map[int]*Room    // room currently accepting players, by requested size
+	filled       map[int]int      // players assigned so far to pending[size]
+	full         map[int]*Room    // room that reached `size` players but hasn't retired, by size; where observers attach once pending[size] is gone
+	rooms        map[string]*Room // every room that hasn't yet retired, by id; read by /stats
+}
+
+// newMatchmaker returns an empty Matchmaker using the given ICE
+// configuration for every room it spawns.
+func newMatchmaker(iceConfig webrtc.Configuration) *Matchmaker {
+	return &Matchmaker{
+		iceConfig: iceConfig,
+		pending:   make(map[int]*Room),
+		filled:    make(map[int]int),
+		full:      make(map[int]*Room),
+		rooms:     make(map[string]*Room),
+	}
+}
+
+// retireRoom drops a room from the set of active rooms once it empties out,
+// along with any pending/filled/full bookkeeping still pointing at it — a
+// room can empty out (e.g. its one member leaves) before ever filling up,
+// and leaving it in m.pending or m.full would hand the next join for that
+// size a room whose inbox is about to close. Passed to newRoom as its
+// onEmpty callback.
+func (m *Matchmaker) retireRoom(id string) {
+	m.mu.Lock()
+	delete(m.rooms, id)
+	for size, room := range m.pending {
+		if room.id == id {
+			delete(m.pending, size)
+			delete(m.filled, size)
+		}
+	}
+	for size, room := range m.full {
+		if room.id == id {
+			delete(m.full, size)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// activeRooms returns a snapshot of every room currently tracked by the
+// Matchmaker, for the /stats endpoint.
+func (m *Matchmaker) activeRooms() []*Room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, r := range m.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+// roomByID returns the active room with the given id, or nil if none
+// matches (either unknown or already retired).
+func (m *Matchmaker) roomByID(id string) *Room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rooms[id]
+}
+
+// newPlayerID returns the next globally unique player id.
+func (m *Matchmaker) newPlayerID() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextPlayerID++
+	return m.nextPlayerID
+}
+
+// join assigns p to a room of the requested size and role, spawning a new
+// room if none is currently filling. Once a room has been assigned `size`
+// players it is retired from the pending set and recorded in m.full so
+// observers keep finding it; a later player join for the same size starts a
+// fresh room rather than reusing the full one.
+//
+// An observer prefers m.full[size] over m.pending[size]: once a room has
+// its full player roster, a new observer should watch those publishers
+// rather than land alone in a brand-new, player-less room of the same size.
+// A room still filling with players is still a reasonable place to observe,
+// so pending is the fallback rather than excluded.
+//
+// The room picked under m.mu can still retire (and close its inbox) before
+// the event below reaches it — its last member can leave concurrently,
+// independently of the bookkeeping this method just did. trySendRoomEvent
+// reports that race back as ok=false, same as Room.snapshot does for the
+// equivalent race on the stats path, and join simply retries against
+// whatever room is current now.
+func (m *Matchmaker) join(p *player, size int, rl role) *Room {
+	for {
+		m.mu.Lock()
+		var room *Room
+		var ok bool
+		if rl == roleObserver {
+			room, ok = m.full[size]
+		}
+		if !ok {
+			room, ok = m.pending[size]
+		}
+		if !ok {
+			m.nextRoomID++
+			room = newRoom(fmt.Sprintf("room-%d", m.nextRoomID), size, m.iceConfig, m.retireRoom)
+			m.pending[size] = room
+			m.rooms[room.id] = room
+		}
+
+		if rl == rolePlayer {
+			m.filled[size]++
+			if m.filled[size] >= size {
+				delete(m.pending, size)
+				delete(m.filled, size)
+				m.full[size] = room
+			}
+		}
+		m.mu.Unlock()
+
+		if trySendRoomEvent(room, roomEvent{kind: roomJoin, player: p, role: rl}) {
+			return room
+		}
+	}
+}
+
+// trySendRoomEvent delivers ev to room's inbox, reporting ok=false instead
+// of panicking if room has already retired and closed its inbox out from
+// under the caller.
+func trySendRoomEvent(room *Room, ev roomEvent) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	room.inbox <- ev
+	return true
+}
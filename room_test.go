@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"github.com/cardboardcrusaders/cardboard-calamity-server/internal/service"
+)
+
+// newTestObserver returns a player with no up/down connections, wired up the
+// way joinPlayer leaves it except for the parts that require a real socket.
+func newTestObserver(id int) *player {
+	p := &player{id: id, active: true}
+	p.peer = service.NewPeer(p)
+	return p
+}
+
+// TestMatchmakerJoinConcurrentRoomAccess exercises Matchmaker.join (which
+// sets p.room/p.role from the room's actor goroutine) concurrently with
+// reads of p.room through currentRoom, which goes through p.peer.Enqueue just
+// as finalizePlayer and resumePlayer do inline. Run with -race: before room/role were routed through
+// p.peer.Enqueue, this reproduced a data race on every run.
+func TestMatchmakerJoinConcurrentRoomAccess(t *testing.T) {
+	mm := newMatchmaker(webrtc.Configuration{})
+
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			p := newTestObserver(id)
+			defer p.peer.Close()
+
+			room := mm.join(p, n, roleObserver)
+			if room == nil {
+				t.Error("join returned a nil room")
+				return
+			}
+
+			// handleJoin runs on the room's actor asynchronously, so
+			// currentRoom may briefly still read nil; poll rather than
+			// assert immediately. The point of this test is the *race
+			// detector* finding no data race on p.room, not timing.
+			deadline := time.Now().Add(time.Second)
+			for p.currentRoom() == nil && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := p.currentRoom(); got != room {
+				t.Errorf("currentRoom() = %v, want %v", got, room)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestMatchmakerRejoinAfterRoomRetiresBeforeFilling checks that a room which
+// empties out before ever reaching its requested size is fully cleared from
+// Matchmaker.pending/filled, not just m.rooms: before retireRoom cleared
+// those too, the next join for the same size would reuse the retired room's
+// already-closed inbox and panic.
+func TestMatchmakerRejoinAfterRoomRetiresBeforeFilling(t *testing.T) {
+	mm := newMatchmaker(webrtc.Configuration{})
+
+	p1 := newTestObserver(1)
+	room1 := mm.join(p1, 2, roleObserver)
+
+	deadline := time.Now().Add(time.Second)
+	for p1.currentRoom() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	room1.inbox <- roomEvent{kind: roomLeave, player: p1}
+
+	deadline = time.Now().Add(time.Second)
+	for mm.roomByID(room1.id) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if mm.roomByID(room1.id) != nil {
+		t.Fatal("room1 never retired")
+	}
+
+	p2 := newTestObserver(2)
+	room2 := mm.join(p2, 2, roleObserver) // would panic pre-fix: send on closed room1.inbox
+	if room2 == room1 {
+		t.Fatalf("join handed out retired room %v", room1.id)
+	}
+}
+
+// TestResolveMemberConcurrentWithJoinLeave exercises resolveMember (the way
+// handleDownAnswer/addICECandidate use it from a player's own event loop)
+// concurrently with the actor's own handleJoin/handleLeave appending to and
+// re-slicing r.members. Run with -race: calling byID directly from another
+// goroutine instead reproduced a data race on every run.
+func TestResolveMemberConcurrentWithJoinLeave(t *testing.T) {
+	mm := newMatchmaker(webrtc.Configuration{})
+
+	const n = 8
+	room := mm.join(newTestObserver(0), n, roleObserver)
+
+	var wg sync.WaitGroup
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			p := newTestObserver(id)
+			defer p.peer.Close()
+			joined := mm.join(p, n, roleObserver)
+			joined.inbox <- roomEvent{kind: roomLeave, player: p}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			room.resolveMember(0)
+		}
+	}()
+
+	wg.Wait()
+}
+
+// TestMatchmakerObserverJoinsFullRoom checks that an observer joining after
+// a room has filled its player roster attaches to that same room rather
+// than spawning a fresh, player-less one of its own: before m.full tracked
+// already-full rooms, the deleted m.pending[size] entry meant the observer
+// always landed alone.
+func TestMatchmakerObserverJoinsFullRoom(t *testing.T) {
+	mm := newMatchmaker(webrtc.Configuration{})
+
+	p1, p2 := newTestObserver(1), newTestObserver(2)
+	room1 := mm.join(p1, 2, rolePlayer)
+	room2 := mm.join(p2, 2, rolePlayer)
+	if room1 != room2 {
+		t.Fatalf("two players requesting size 2 landed in different rooms: %v, %v", room1.id, room2.id)
+	}
+
+	observer := newTestObserver(3)
+	roomObs := mm.join(observer, 2, roleObserver)
+	if roomObs != room1 {
+		t.Fatalf("observer joined room %v, want the full room %v", roomObs.id, room1.id)
+	}
+}
+
+// TestSendToMemberDropsWhenFull verifies that sendToMember never blocks the
+// caller, even when a member's writeCh is saturated: the room actor would
+// otherwise stall every other member's roster/resume/stats traffic behind
+// one wedged connection.
+func TestSendToMemberDropsWhenFull(t *testing.T) {
+	p := newTestObserver(1)
+	p.writeCh = make(chan interface{}, 1)
+	p.writeCh <- envelope{Type: envRoster} // fill the buffer
+
+	done := make(chan struct{})
+	go func() {
+		sendToMember(p, envelope{Type: envRoster})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sendToMember blocked on a full writeCh instead of dropping")
+	}
+
+	if len(p.writeCh) != 1 {
+		t.Errorf("writeCh length = %d, want 1 (dropped message should not be enqueued)", len(p.writeCh))
+	}
+}
+
+// TestHandleLeaveRemovesMember checks that handleLeave splices a departing
+// player out of r.members without disturbing the others.
+func TestHandleLeaveRemovesMember(t *testing.T) {
+	r := &Room{id: "room-test"}
+	a, b, c := newTestObserver(1), newTestObserver(2), newTestObserver(3)
+	r.members = []*player{a, b, c}
+
+	r.handleLeave(b)
+
+	if len(r.members) != 2 {
+		t.Fatalf("members = %v, want 2 entries", r.members)
+	}
+	for _, m := range r.members {
+		if m == b {
+			t.Fatalf("handleLeave did not remove the departing member: %v", r.members)
+		}
+	}
+}
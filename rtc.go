@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// trackStats accumulates the byte/packet counters reported by the /stats
+// endpoint for a single track leg. They are running totals since the leg was
+// created; no per-interval history is kept. All fields are updated with the
+// atomic package since the forwarding goroutine and the stats HTTP handler
+// run concurrently.
+type trackStats struct {
+	txBytes   uint64
+	txPackets uint64
+	rxBytes   uint64
+	rxPackets uint64
+	nulled    uint64 // packets dropped because a WriteRTP call failed
+	deficit   uint64 // gap detected in incoming RTP sequence numbers
+}
+
+func (s *trackStats) addRx(n int) {
+	atomic.AddUint64(&s.rxBytes, uint64(n))
+	atomic.AddUint64(&s.rxPackets, 1)
+}
+
+func (s *trackStats) addTx(n int) {
+	atomic.AddUint64(&s.txBytes, uint64(n))
+	atomic.AddUint64(&s.txPackets, 1)
+}
+
+func (s *trackStats) addNulled() {
+	atomic.AddUint64(&s.nulled, 1)
+}
+
+func (s *trackStats) addDeficit(n uint64) {
+	atomic.AddUint64(&s.deficit, n)
+}
+
+// snapshot returns a copy of s safe to serialize, reading every counter
+// atomically.
+func (s *trackStats) snapshot() trackStats {
+	return trackStats{
+		txBytes:   atomic.LoadUint64(&s.txBytes),
+		txPackets: atomic.LoadUint64(&s.txPackets),
+		rxBytes:   atomic.LoadUint64(&s.rxBytes),
+		rxPackets: atomic.LoadUint64(&s.rxPackets),
+		nulled:    atomic.LoadUint64(&s.nulled),
+		deficit:   atomic.LoadUint64(&s.deficit),
+	}
+}
+
+// rtpUpConnection is the peer connection a player publishes their camera
+// track on. Every player owns exactly one.
+type rtpUpConnection struct {
+	pc    *webrtc.PeerConnection
+	stats trackStats
+
+	mu    sync.Mutex
+	track *webrtc.TrackRemote  // set once the publisher's offer negotiates a track; guarded by mu since OnTrack writes it from pion's own goroutine
+	subs  []*rtpDownConnection // down-connections currently forwarding this track
+}
+
+// setTrack records up's published track, guarding the write against the
+// concurrent reads in getTrack from subscribeTrack/forwardTrack.
+func (up *rtpUpConnection) setTrack(track *webrtc.TrackRemote) {
+	up.mu.Lock()
+	up.track = track
+	up.mu.Unlock()
+}
+
+// getTrack returns up's published track, or nil if the publisher's offer
+// hasn't negotiated one yet.
+func (up *rtpUpConnection) getTrack() *webrtc.TrackRemote {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.track
+}
+
+// snapshotSubs returns a copy of up's current subscriber list, safe to range
+// over without holding up.mu.
+func (up *rtpUpConnection) snapshotSubs() []*rtpDownConnection {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return append([]*rtpDownConnection(nil), up.subs...)
+}
+
+// rtpDownConnection forwards one publisher's track back down to a
+// subscriber. A player owns one rtpDownConnection per publisher whose video
+// they receive, keyed by that publisher in player.downs.
+type rtpDownConnection struct {
+	pc           *webrtc.PeerConnection
+	sender       *webrtc.RTPSender
+	localTrack   *webrtc.TrackLocalStaticRTP
+	subscriberID int // id of the player this down-connection forwards to
+	stats        trackStats
+
+	lastSeq uint16
+	haveSeq bool
+}
+
+// observeSeq updates down's deficit counter by any gap between the last RTP
+// sequence number it saw and seq.
+func (down *rtpDownConnection) observeSeq(seq uint16) {
+	if down.haveSeq {
+		if gap := seq - down.lastSeq - 1; gap > 0 && gap < 1<<15 {
+			down.stats.addDeficit(uint64(gap))
+		}
+	}
+	down.lastSeq = seq
+	down.haveSeq = true
+}
+
+// newUpConnection creates the peer connection owner will publish their
+// camera track on and wires an OnTrack handler that records the published
+// track, starts pumping it to subscribers' down-connections, and notifies
+// owner's room so members already in the room (re)subscribe to it — the
+// track doesn't exist yet at join time, only once the publisher's offer
+// negotiates it here.
+func newUpConnection(config webrtc.Configuration, owner *player) (*rtpUpConnection, error) {
+	pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		return nil, fmt.Errorf("new up connection: %w", err)
+	}
+	closeOnFailure(pc, "up")
+	trickleICECandidates(pc, owner, "up")
+
+	up := &rtpUpConnection{pc: pc}
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Println("received published track", track.ID())
+		up.setTrack(track)
+		go pumpUpTrack(up)
+		notifyTrackReady(owner)
+	})
+
+	return up, nil
+}
+
+// newDownConnection creates the peer connection used to forward pub's
+// published track down to sub, trickling sub's locally gathered candidates
+// back over sub's websocket addressed by downConnID(pub).
+func newDownConnection(config webrtc.Configuration, sub *player, pub *player) (*rtpDownConnection, error) {
+	pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		return nil, fmt.Errorf("new down connection: %w", err)
+	}
+	closeOnFailure(pc, "down")
+	trickleICECandidates(pc, sub, downConnID(pub))
+
+	return &rtpDownConnection{pc: pc}, nil
+}
+
+// trickleICECandidates registers pc's OnICECandidate handler so every
+// locally gathered candidate is pushed to owner over envICE, addressed by
+// connID ("up", or downConnID(pub) for a down-connection) — the outbound
+// half of the trickle exchange; addICECandidate below applies the inbound
+// half. Without this the client never learns the server's candidates and
+// ICE never pairs. Candidate gathering runs on pion's own goroutine, so
+// delivery goes through sendToMember rather than touching owner.writeCh
+// directly.
+func trickleICECandidates(pc *webrtc.PeerConnection, owner *player, connID string) {
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return // nil marks the end of gathering; nothing to trickle.
+		}
+		init := c.ToJSON()
+		sendToMember(owner, envelope{Type: envICE, Conn: connID, Candidate: &init})
+	})
+}
+
+// closeOnFailure closes pc once its ICE connection state reaches a
+// terminal failure or disconnection, so an abandoned offer/answer exchange
+// or a client that vanishes mid-call doesn't leave its ICE agent, DTLS
+// transport, and any RTP reader goroutine running forever. label is only
+// used for logging ("up" or "down").
+func closeOnFailure(pc *webrtc.PeerConnection, label string) {
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateDisconnected {
+			log.Println(label, "connection", state, "- closing")
+			if err := pc.Close(); err != nil {
+				log.Println("close", label, "connection:", err)
+			}
+		}
+	})
+}
+
+// forwardTrack wires src's published up-track onto dst's down-connection,
+// mirroring Galene's rtpconn.addDownConnection, and registers dst to receive
+// packets from src's forwarding goroutine.
+func forwardTrack(src *rtpUpConnection, dst *rtpDownConnection) error {
+	if src == nil || dst == nil {
+		return nil
+	}
+	track := src.getTrack()
+	if track == nil {
+		return nil
+	}
+
+	local, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
+	if err != nil {
+		return fmt.Errorf("forward track: %w", err)
+	}
+
+	sender, err := dst.pc.AddTrack(local)
+	if err != nil {
+		return fmt.Errorf("forward track: %w", err)
+	}
+	dst.sender = sender
+	dst.localTrack = local
+
+	src.mu.Lock()
+	src.subs = append(src.subs, dst)
+	src.mu.Unlock()
+
+	return nil
+}
+
+// pumpUpTrack reads src's published RTP stream and fans each packet out to
+// every subscribed down-connection, updating the running totals /stats
+// reports. It returns once the published track's reader is closed.
+func pumpUpTrack(src *rtpUpConnection) {
+	track := src.getTrack()
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		n := pkt.MarshalSize()
+		src.stats.addRx(n)
+
+		src.mu.Lock()
+		subs := append([]*rtpDownConnection(nil), src.subs...)
+		src.mu.Unlock()
+
+		for _, down := range subs {
+			down.observeSeq(pkt.SequenceNumber)
+			if err := down.localTrack.WriteRTP(pkt); err != nil {
+				down.stats.addNulled()
+				continue
+			}
+			down.stats.addTx(n)
+		}
+	}
+}
+
+// subscribeTrack creates a down-connection on sub for pub's published track
+// and offers it over sub's websocket, addressed by downConnID(pub). It is a
+// no-op if pub hasn't published a track yet or sub is already subscribed.
+//
+// sub.downs is also read and written by the offer/answer/ice PacketHandlers
+// running on sub's own service.Peer event loop, so every mutation here runs
+// there too via Enqueue rather than directly on the caller's goroutine
+// (typically a room's actor).
+func subscribeTrack(sub *player, pub *player, iceConfig webrtc.Configuration) {
+	if sub == pub || pub.up == nil || pub.up.getTrack() == nil {
+		return
+	}
+
+	err := sub.peer.Enqueue(func() error {
+		if sub.downs == nil {
+			sub.downs = make(map[*player]*rtpDownConnection)
+		}
+		if _, ok := sub.downs[pub]; ok {
+			return nil
+		}
+
+		down, err := newDownConnection(iceConfig, sub, pub)
+		if err != nil {
+			return err
+		}
+		down.subscriberID = sub.id
+		if err := forwardTrack(pub.up, down); err != nil {
+			return err
+		}
+		sub.downs[pub] = down
+
+		offer, err := down.pc.CreateOffer(nil)
+		if err != nil {
+			return err
+		}
+		if err := down.pc.SetLocalDescription(offer); err != nil {
+			return err
+		}
+
+		if sub.writeCh != nil {
+			sub.writeCh <- envelope{Type: envOffer, Conn: downConnID(pub), SDP: &offer}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("subscribe track:", err)
+	}
+}
+
+// removeSub splices down out of src's subscriber list so pumpUpTrack stops
+// forwarding to it. A no-op if down isn't (or is no longer) subscribed.
+func (src *rtpUpConnection) removeSub(down *rtpDownConnection) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	for i, d := range src.subs {
+		if d == down {
+			src.subs = append(src.subs[:i], src.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// teardownPlayerConnections closes every PeerConnection p owns — its
+// up-connection, if any, and every down-connection in p.downs — and splices
+// each one out of the rtpUpConnection it was forwarding from or to, so
+// leaving a room never leaks a PeerConnection, its ICE agent, or the
+// pumpUpTrack goroutine reading an abandoned track. Called once, from
+// finalizePlayer, on p's own service.Peer event loop.
+func teardownPlayerConnections(p *player) {
+	if p.up != nil {
+		p.up.mu.Lock()
+		subs := append([]*rtpDownConnection(nil), p.up.subs...)
+		p.up.subs = nil
+		p.up.mu.Unlock()
+
+		for _, down := range subs {
+			closeConnection(down.pc, "down")
+		}
+		closeConnection(p.up.pc, "up")
+	}
+
+	for pub, down := range p.downs {
+		pub.up.removeSub(down)
+		closeConnection(down.pc, "down")
+	}
+}
+
+// closeConnection closes pc, logging (rather than returning) any error
+// since teardown runs on the departing player's own event loop with no
+// caller left to hand an error back to.
+func closeConnection(pc *webrtc.PeerConnection, label string) {
+	if pc == nil {
+		return
+	}
+	if err := pc.Close(); err != nil {
+		log.Println("close", label, "connection:", err)
+	}
+}
+
+// downConnID formats the Conn selector that addresses the down-connection
+// subscribed to pub's track.
+func downConnID(pub *player) string {
+	return fmt.Sprintf("down:%d", pub.id)
+}
+
+// parseDownConnID extracts the publisher id from a Conn selector produced by
+// downConnID.
+func parseDownConnID(conn string) (int, bool) {
+	var id int
+	n, err := fmt.Sscanf(conn, "down:%d", &id)
+	if err != nil || n != 1 {
+		return 0, false
+	}
+	return id, true
+}
+
+// addICECandidate applies a trickled ICE candidate to one of p's peer
+// connections, selected by conn ("up", or "down:<publisherId>").
+func addICECandidate(p *player, conn string, candidate webrtc.ICECandidateInit) error {
+	if conn == "up" {
+		if p.up == nil {
+			return fmt.Errorf("%w: player has not published", errProtocolViolation)
+		}
+		if err := p.up.pc.AddICECandidate(candidate); err != nil {
+			return fmt.Errorf("add ice candidate: %w", err)
+		}
+		return nil
+	}
+
+	pubID, ok := parseDownConnID(conn)
+	if !ok {
+		return fmt.Errorf("%w: unknown connection %q", errProtocolViolation, conn)
+	}
+	if p.room == nil {
+		return fmt.Errorf("%w: not yet assigned to a room", errUnknownPlayer)
+	}
+	pub, ok := p.room.resolveMember(pubID)
+	if !ok || pub == nil {
+		return fmt.Errorf("%w: unknown publisher %d", errUnknownPlayer, pubID)
+	}
+	down, ok := p.downs[pub]
+	if !ok {
+		return fmt.Errorf("%w: not subscribed to publisher %d", errUnknownPlayer, pubID)
+	}
+
+	if err := down.pc.AddICECandidate(candidate); err != nil {
+		return fmt.Errorf("add ice candidate: %w", err)
+	}
+
+	return nil
+}
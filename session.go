@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// gracePeriod is how long a dropped connection's session stays resumable
+// before the reaper finalizes it and tells the room it left for good.
+const gracePeriod = 30 * time.Second
+
+// generateSID returns a random, URL-safe session id for a newly joined
+// player.
+func generateSID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate sid: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// sessionRegistry maps session ids to the player behind them, and tracks
+// which sessions are currently in their post-disconnect grace period.
+type sessionRegistry struct {
+	mu             sync.Mutex
+	bySID          map[string]*player
+	disconnectedAt map[string]time.Time
+}
+
+// newSessionRegistry returns an empty sessionRegistry.
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		bySID:          make(map[string]*player),
+		disconnectedAt: make(map[string]time.Time),
+	}
+}
+
+// register associates a freshly generated sid with p.
+func (sr *sessionRegistry) register(sid string, p *player) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.bySID[sid] = p
+}
+
+// resume looks up sid and, if it is within its grace period, cancels the
+// pending finalization and returns its player. A sid that is unknown or not
+// currently disconnected (e.g. still connected elsewhere) is refused.
+func (sr *sessionRegistry) resume(sid string) (*player, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	p, ok := sr.bySID[sid]
+	if !ok {
+		return nil, false
+	}
+	if _, disconnected := sr.disconnectedAt[sid]; !disconnected {
+		return nil, false
+	}
+
+	delete(sr.disconnectedAt, sid)
+	return p, true
+}
+
+// markDisconnected starts sid's grace period.
+func (sr *sessionRegistry) markDisconnected(sid string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.disconnectedAt[sid] = time.Now()
+}
+
+// forget removes sid entirely, e.g. after a voluntary leave.
+func (sr *sessionRegistry) forget(sid string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	delete(sr.bySID, sid)
+	delete(sr.disconnectedAt, sid)
+}
+
+// reap periodically finalizes any session whose grace period has elapsed,
+// deactivating its player and telling its room it left for good. It runs
+// until the process exits.
+func (sr *sessionRegistry) reap() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sr.mu.Lock()
+		now := time.Now()
+		var expired []string
+		for sid, at := range sr.disconnectedAt {
+			if now.Sub(at) >= gracePeriod {
+				expired = append(expired, sid)
+			}
+		}
+
+		players := make([]*player, 0, len(expired))
+		for _, sid := range expired {
+			players = append(players, sr.bySID[sid])
+			delete(sr.disconnectedAt, sid)
+			delete(sr.bySID, sid)
+		}
+		sr.mu.Unlock()
+
+		for _, p := range players {
+			log.Println("session for player", p.id, "expired after grace period")
+			finalizePlayer(p)
+		}
+	}
+}
+
+// suspendPlayer marks p inactive without telling its room, since the drop
+// might just be a reconnect in progress.
+func suspendPlayer(p *player) {
+	p.peer.Enqueue(func() error {
+		p.active = false
+		return nil
+	})
+}
+
+// resumePlayer reattaches conn to the player behind sid if it disconnected
+// within the grace period, returning nil if sid is unknown or expired so the
+// caller falls back to a fresh join.
+func resumePlayer(sessions *sessionRegistry, sid string, conn *websocket.Conn) *player {
+	p, ok := sessions.resume(sid)
+	if !ok {
+		return nil
+	}
+
+	writeCh := make(chan interface{}, 16)
+
+	var room *Room
+	p.peer.Enqueue(func() error {
+		p.active = true
+		p.conn = conn
+		p.writeCh = writeCh
+		room = p.room
+		return nil
+	})
+
+	go writePump(conn, writeCh)
+
+	log.Println("player", p.id, "resumed session")
+
+	roomID := ""
+	if room != nil {
+		roomID = room.id
+	}
+	writeCh <- envelope{Type: envJoin, ID: p.id, SID: sid, RoomID: roomID}
+
+	if room != nil {
+		room.inbox <- roomEvent{kind: roomResumed, player: p}
+	}
+
+	return p
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+// serverStats is the payload served by GET /stats, modeled loosely on
+// Lavalink's RemoteStats: headline counts across every active room, plus a
+// per-room breakdown operators can point Prometheus/Grafana at.
+type serverStats struct {
+	Players   int            `json:"players"`
+	Rooms     int            `json:"rooms"`
+	Memory    memoryStats    `json:"memory"`
+	CPU       cpuStats       `json:"cpu"`
+	RoomStats []roomSnapshot `json:"roomStats"`
+}
+
+// memoryStats summarizes runtime.MemStats for the stats payload.
+type memoryStats struct {
+	HeapAllocBytes uint64 `json:"heapAllocBytes"`
+	HeapSysBytes   uint64 `json:"heapSysBytes"`
+	NumGC          uint32 `json:"numGc"`
+}
+
+// cpuStats summarizes the host's current CPU load, as reported by gopsutil.
+type cpuStats struct {
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+// collectMemoryStats reads the current Go runtime memory profile.
+func collectMemoryStats() memoryStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return memoryStats{
+		HeapAllocBytes: m.HeapAlloc,
+		HeapSysBytes:   m.HeapSys,
+		NumGC:          m.NumGC,
+	}
+}
+
+// collectCPUStats asks gopsutil for CPU usage since the previous call,
+// without blocking to sample. The very first call reports usage since
+// gopsutil's own initial sample, taken when its package is initialized.
+// Failures are logged and reported as zero rather than failing the whole
+// /stats request.
+func collectCPUStats() cpuStats {
+	percents, err := cpu.Percent(0, false)
+	if err != nil || len(percents) == 0 {
+		log.Println("stats: read cpu percent:", err)
+		return cpuStats{}
+	}
+	return cpuStats{UsedPercent: percents[0]}
+}
+
+// statsHandler serves GET /stats (every active room) and GET /stats/{roomID}
+// (a single room), both as JSON.
+func statsHandler(mm *Matchmaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		switch {
+		case path == "/stats":
+			writeStatsJSON(w, collectServerStats(mm))
+
+		default:
+			roomID := strings.TrimPrefix(path, "/stats/")
+			if roomID == path || roomID == "" {
+				http.NotFound(w, r)
+				return
+			}
+			room := mm.roomByID(roomID)
+			if room == nil {
+				http.NotFound(w, r)
+				return
+			}
+			snap, ok := room.snapshot()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeStatsJSON(w, snap)
+		}
+	}
+}
+
+// collectServerStats gathers a roomSnapshot for every active room and
+// totals up the headline counts.
+func collectServerStats(mm *Matchmaker) serverStats {
+	rooms := mm.activeRooms()
+	snaps := make([]roomSnapshot, 0, len(rooms))
+	players := 0
+	for _, room := range rooms {
+		snap, ok := room.snapshot()
+		if !ok {
+			continue
+		}
+		snaps = append(snaps, snap)
+		players += snap.Players
+	}
+
+	return serverStats{
+		Players:   players,
+		Rooms:     len(snaps),
+		Memory:    collectMemoryStats(),
+		CPU:       collectCPUStats(),
+		RoomStats: snaps,
+	}
+}
+
+func writeStatsJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("stats: encode response:", err)
+	}
+}
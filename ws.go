@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// errProtocolViolation and errUnknownPlayer are the sentinel errors
+// errorToWSCloseMessage knows how to map to a close code.
+var (
+	errProtocolViolation = errors.New("protocol violation")
+	errUnknownPlayer     = errors.New("no such player in this room")
+)
+
+// wsUpgrader upgrades the /ws HTTP connection to a websocket. It uses the
+// library defaults for buffer sizes and leaves origin checking to the
+// default same-origin policy.
+var wsUpgrader = websocket.Upgrader{}
+
+// envelopeType tags the payload of a message sent over /ws.
+type envelopeType string
+
+const (
+	envJoin    envelopeType = "join"
+	envLeave   envelopeType = "leave"
+	envOffer   envelopeType = "offer"
+	envAnswer  envelopeType = "answer"
+	envICE     envelopeType = "ice"
+	envRoster  envelopeType = "roster"
+	envResumed envelopeType = "resumed"
+	envError   envelopeType = "error"
+)
+
+// envelope is the tagged JSON message exchanged over the /ws control
+// channel. Only the fields relevant to Type are populated.
+type envelope struct {
+	Type envelopeType `json:"type"`
+
+	// Sent back to the client in response to envJoin: the assigned player
+	// id and its session id, which must be presented as ?sid= to resume
+	// this session after a dropped connection.
+	ID  int    `json:"id,omitempty"`
+	SID string `json:"sid,omitempty"`
+
+	// Sent by the client as part of envJoin: Mode is "pair" or "group",
+	// Size is the room capacity (2 for "pair"), Role is "player" or
+	// "observer".
+	Mode string `json:"mode,omitempty"`
+	Size int    `json:"size,omitempty"`
+	Role string `json:"role,omitempty"`
+
+	// envOffer/envAnswer/envICE: Conn selects which of the player's peer
+	// connections the message applies to: "up", or "down:<publisherId>"
+	// for a down-connection subscribed to that publisher's track.
+	Conn      string                     `json:"conn,omitempty"`
+	SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+
+	// envRoster broadcasts a room's current member ids; envResumed notifies
+	// the rest of a room that the member with ID reconnected before its
+	// grace period elapsed.
+	RoomID  string `json:"roomId,omitempty"`
+	Members []int  `json:"members,omitempty"`
+
+	// envError carries a human-readable error for protocol/user mistakes
+	// that aren't severe enough to close the socket.
+	Error string `json:"error,omitempty"`
+}
+
+// errorToWSCloseMessage maps an error to a websocket close frame, using a
+// distinct close code for protocol violations versus ordinary user errors
+// so clients can tell a malformed message from a reference to a player that
+// isn't in their room.
+func errorToWSCloseMessage(err error) []byte {
+	code := websocket.CloseInternalServerErr
+	switch {
+	case errors.Is(err, errProtocolViolation):
+		code = websocket.ClosePolicyViolation
+	case errors.Is(err, errUnknownPlayer):
+		code = websocket.CloseTryAgainLater
+	}
+	return websocket.FormatCloseMessage(code, err.Error())
+}
+
+// writePump relays messages enqueued on writeCh to the websocket connection,
+// one at a time, until the channel is closed or a write fails. Every
+// player's outbound traffic flows through its own writePump goroutine so
+// that handlers pushing notifications (roster, offer, ice, ...) never need
+// to touch the connection directly.
+func writePump(conn *websocket.Conn, writeCh <-chan interface{}) {
+	for msg := range writeCh {
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Println("ws write:", err)
+			return
+		}
+	}
+}